@@ -2,24 +2,44 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/microcosm-cc/bluemonday"
 	"github.com/russross/blackfriday/v2"
 )
 
-var imgExtensions = map[string]int{".png": 1, ".jpg": 1, ".jpeg": 1}
-var vidExtensions = map[string]int{".mp4": 1}
-var wavExtensions = map[string]int{".wav": 1}
+var imgExtensions = map[string]int{".png": 1, ".jpg": 1, ".jpeg": 1, ".gif": 1, ".webp": 1}
+var vidExtensions = map[string]int{".mp4": 1, ".webm": 1}
+var wavExtensions = map[string]int{".wav": 1, ".mp3": 1, ".ogg": 1, ".flac": 1}
+
+// MIME types to fall back on when sniffing the file content is inconclusive
+var extMimeTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+	".wav":  "audio/x-wav",
+	".mp3":  "audio/mpeg",
+	".ogg":  "audio/ogg",
+	".flac": "audio/flac",
+}
 
 const mediaTypeImg = 0
 const mediaTypeVid = 1
@@ -62,6 +82,122 @@ func (m MediaFiles) ToMap() map[string]*MediaFile {
 	return ret
 }
 
+// a cell of a media line: a media file name, followed by an optional caption
+type MediaCell struct {
+	name    string
+	caption string
+}
+
+// a whitespace delimited word of a media line, or a "|", with its position
+// in the line
+type lineToken struct {
+	text  string
+	start int
+	end   int
+}
+
+// split a line on whitespace, with every "|" being a token of its own, even
+// when it is not surrounded by whitespace
+func tokenizeMediaLine(line string) []lineToken {
+	var tokens []lineToken
+	start := -1
+	for i, r := range line {
+		if unicode.IsSpace(r) || r == '|' {
+			if start >= 0 {
+				tokens = append(tokens, lineToken{line[start:i], start, i})
+				start = -1
+			}
+			if r == '|' {
+				tokens = append(tokens, lineToken{"|", i, i + 1})
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, lineToken{line[start:], start, len(line)})
+	}
+	return tokens
+}
+
+// a media line is a line starting with the name of a media file
+func isMediaLine(line string, allMedia map[string]*MediaFile) bool {
+	tokens := tokenizeMediaLine(line)
+	if len(tokens) == 0 {
+		return false
+	}
+	_, ok := allMedia[tokens[0].text]
+	return ok
+}
+
+// split a media line into its cells. Everything after a "|" following a
+// media file name is that file's caption. The caption ends at the next word
+// equal to the name of a media file, which starts a new cell.
+func parseMediaLine(line string, allMedia map[string]*MediaFile) []MediaCell {
+	var cells []MediaCell
+	captionStart := -1
+
+	for _, token := range tokenizeMediaLine(line) {
+		_, isMedia := allMedia[token.text]
+		if captionStart >= 0 && !isMedia {
+			continue
+		}
+		if captionStart >= 0 {
+			cells[len(cells)-1].caption = strings.TrimSpace(line[captionStart:token.start])
+			captionStart = -1
+		}
+		if token.text == "|" && len(cells) > 0 {
+			captionStart = token.end
+			continue
+		}
+		cells = append(cells, MediaCell{token.text, ""})
+	}
+	if captionStart >= 0 {
+		cells[len(cells)-1].caption = strings.TrimSpace(line[captionStart:])
+	}
+	return cells
+}
+
+func markdownToHtml(markdown string) string {
+	unsafe := blackfriday.Run([]byte(markdown))
+	html := bluemonday.UGCPolicy().SanitizeBytes(unsafe)
+	return string(html)
+}
+
+// escape a leading heading, quote, list, rule or code fence marker, so that
+// a line of markdown renders as a single paragraph
+func escapeBlockMarkdown(text string) string {
+	digits := 0
+	for digits < len(text) && text[digits] >= '0' && text[digits] <= '9' {
+		digits++
+	}
+	if digits > 0 {
+		if strings.HasPrefix(text[digits:], ". ") || strings.HasPrefix(text[digits:], ") ") {
+			return text[:digits] + "\\" + text[digits:]
+		}
+		return text
+	}
+	if strings.HasPrefix(text, "#") || strings.HasPrefix(text, ">") ||
+		strings.HasPrefix(text, "```") || strings.HasPrefix(text, "~~~") ||
+		strings.HasPrefix(text, "- ") || strings.HasPrefix(text, "+ ") ||
+		strings.HasPrefix(text, "* ") ||
+		strings.Trim(text, "-* ") == "" {
+		return "\\" + text
+	}
+	return text
+}
+
+// render a single line of markdown with inline markup only, i.e. without
+// the wrapping paragraph
+func inlineMarkdownToHtml(markdown string) string {
+	unsafe := blackfriday.Run([]byte(escapeBlockMarkdown(markdown)))
+	unsafe = bytes.TrimSpace(unsafe)
+	unsafe = bytes.TrimPrefix(unsafe, []byte("<p>"))
+	unsafe = bytes.TrimSuffix(unsafe, []byte("</p>"))
+	html := bluemonday.UGCPolicy().SanitizeBytes(unsafe)
+	return string(html)
+}
+
 func getExeFolder() string {
 	exe, _ := os.Executable()
 	path, _ := filepath.Split(exe)
@@ -201,9 +337,47 @@ func parseFolder(lines []string) (string, error) {
 	return "", errors.New("No folder in album file")
 }
 
-func loadMedia(lines []string, folder string, allMedia *map[string]*MediaFile) {
-	c := make(chan int)
-	numMedia := 0
+func parseLinkMedia(lines []string) bool {
+	for _, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == ':' {
+			// we have a control line
+			cols := strings.Fields(line)
+			switch cols[0] {
+			case ":link_media":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compute the folder media links are relative to, i.e. the path from the
+// directory of the output file to the media folder
+func getLinkFolder(outFile string, folder string) (string, error) {
+	absOutDir, err := filepath.Abs(filepath.Dir(outFile))
+	if err != nil {
+		return "", err
+	}
+	absFolder, err := filepath.Abs(folder)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(absOutDir, absFolder)
+}
+
+// if linkFolder is not empty, media is linked relative to it instead of
+// being embedded. At most numWorkers files are loaded at the same time.
+func loadMedia(lines []string, folder string, linkFolder string, numWorkers int, allMedia *map[string]*MediaFile) {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
+	// collect every media file referenced by the album, once
+	var mediaCols []string
+	queued := make(map[string]bool)
 	for _, line := range lines {
 		if len(line) == 0 {
 			continue
@@ -212,44 +386,48 @@ func loadMedia(lines []string, folder string, allMedia *map[string]*MediaFile) {
 			continue
 		} else {
 			// we have a media or markdown line
-			cols := strings.Fields(line)
-			if len(cols) == 0 {
-				continue
-			}
-			if _, ok := (*allMedia)[cols[0]]; ok {
+			if isMediaLine(line, *allMedia) {
 				// we have a media line
-				for _, col := range cols {
-					if mediaFile, ok := (*allMedia)[col]; ok {
-						switch mediaFile.mediaType {
-						case mediaTypeImg:
-							go func(mediaFile *MediaFile, col string, c chan int) {
-								mediaFile.html = imgToHtml(folder, col)
-								c <- 1
-							}(mediaFile, col, c)
-							numMedia++
-						case mediaTypeVid:
-							go func(mediaFile *MediaFile, col string, c chan int) {
-								mediaFile.html = vidToHtml(folder, col)
-								c <- 1
-							}(mediaFile, col, c)
-							numMedia++
-						case mediaTypeWav:
-							go func(mediaFile *MediaFile, col string, c chan int) {
-								mediaFile.html = wavToHtml(folder, col)
-								c <- 1
-							}(mediaFile, col, c)
-							numMedia++
-						}
+				for _, cell := range parseMediaLine(line, *allMedia) {
+					if _, ok := (*allMedia)[cell.name]; ok && !queued[cell.name] {
+						queued[cell.name] = true
+						mediaCols = append(mediaCols, cell.name)
 					}
 				}
 			}
 		}
 	}
 
+	jobs := make(chan string)
+	c := make(chan int)
+	for w := 0; w < numWorkers; w++ {
+		go func(jobs chan string, c chan int) {
+			for col := range jobs {
+				mediaFile := (*allMedia)[col]
+				switch mediaFile.mediaType {
+				case mediaTypeImg:
+					mediaFile.html = imgToHtml(folder, col, linkFolder)
+				case mediaTypeVid:
+					mediaFile.html = vidToHtml(folder, col, linkFolder)
+				case mediaTypeWav:
+					mediaFile.html = wavToHtml(folder, col, linkFolder)
+				}
+				c <- 1
+			}
+		}(jobs, c)
+	}
+	go func(jobs chan string) {
+		for _, col := range mediaCols {
+			jobs <- col
+		}
+		close(jobs)
+	}(jobs)
+
+	numMedia := len(mediaCols)
 	for i := 0; i < numMedia; i++ {
-		fmt.Print(fmt.Sprintf("\r  Loading image / video %4d of %-4d ", i+1, numMedia))
 		// wait for completion
 		_ = <-c
+		fmt.Print(fmt.Sprintf("\r  Loading image / video %4d of %-4d ", i+1, numMedia))
 	}
 }
 
@@ -259,6 +437,27 @@ func generate(args []string) {
 	}
 
 	inputFile := args[0]
+	linkMedia := false
+	numWorkers := runtime.NumCPU()
+	for i := 1; i < len(args); i++ {
+		switch args[i] {
+		case "--link-media":
+			linkMedia = true
+		case "--jobs":
+			if i+1 >= len(args) {
+				abort("Please specify the number of jobs", 1)
+			}
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil || n < 1 {
+				abort(fmt.Sprintf("Invalid number of jobs: %s", args[i]), 1)
+			}
+			numWorkers = n
+		default:
+			abort(fmt.Sprintf("Unknown option %s\n\n"+usage, args[i], os.Args[0]), 1)
+		}
+	}
+
 	f, err := os.Open(inputFile)
 	if err != nil {
 		panic(err)
@@ -295,8 +494,19 @@ func generate(args []string) {
 	}
 	allMedia = allMediaList.ToMap()
 
+	ext := filepath.Ext(inputFile)
+	outFile := strings.Replace(inputFile, ext, ".html", 1)
+
+	var linkFolder string
+	if linkMedia || parseLinkMedia(lines) {
+		linkFolder, err = getLinkFolder(outFile, folder)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	fmt.Println("The Albummer is processing", inputFile)
-	loadMedia(lines, folder, &allMedia)
+	loadMedia(lines, folder, linkFolder, numWorkers, &allMedia)
 	fmt.Println()
 
 	for lc < lcMax {
@@ -313,6 +523,8 @@ func generate(args []string) {
 			switch cols[0] {
 			case ":show_filenames":
 				// show_filenames = true
+			case ":link_media":
+				// handled before loading the media
 			case ":use":
 				css = cols[1]
 				cssText, err := ioutil.ReadFile(css)
@@ -327,15 +539,19 @@ func generate(args []string) {
 			if len(cols) == 0 {
 				continue
 			}
-			if _, ok := allMedia[cols[0]]; ok {
+			if isMediaLine(line, allMedia) {
 				// we have a media line
-				numCols := len(cols)
+				cells := parseMediaLine(line, allMedia)
+				numCols := len(cells)
 				percent := int(100 / numCols)
 				html := `<div align="center"><table><tr>`
-				for _, col := range cols {
+				for _, cell := range cells {
 					html += fmt.Sprintf(`<td style="width:%d%%;">`, percent)
-					if mediaFile, ok := allMedia[col]; ok {
+					if mediaFile, ok := allMedia[cell.name]; ok {
 						html += mediaFile.html
+						if cell.caption != "" {
+							html += fmt.Sprintf(`<div class="caption">%s</div>`, inlineMarkdownToHtml(cell.caption))
+						}
 						html += `</td><td width="10px"></td>`
 					}
 				}
@@ -351,24 +567,19 @@ func generate(args []string) {
 						markdownLines += "\n" + line
 						continue
 					}
-					cols = strings.Fields(line)
-					if _, ok := allMedia[cols[0]]; ok {
+					if isMediaLine(line, allMedia) {
 						// we have a media line -> end of markdown, put it back
 						lc -= 1
 						break
 					}
 					markdownLines += "\n" + line
 				}
-				unsafe := blackfriday.Run([]byte(markdownLines))
-				html := bluemonday.UGCPolicy().SanitizeBytes(unsafe)
-				htmlBodies = append(htmlBodies, string(html))
+				htmlBodies = append(htmlBodies, markdownToHtml(markdownLines))
 			}
 		}
 	}
 	fmt.Println()
 
-	ext := filepath.Ext(inputFile)
-	outFile := strings.Replace(inputFile, ext, ".html", 1)
 	of, err := os.Create(outFile)
 	if err != nil {
 		panic(err)
@@ -423,35 +634,62 @@ func getAllMedia(root string) (MediaFiles, error) {
 	return files, err
 }
 
-func imgToHtml(folder string, img string) string {
-	data, err := ioutil.ReadFile(filepath.Join(folder, img))
-	if err != nil {
-		return ""
+// detect the MIME type from the file content, then from the extension, and
+// finally use the given default
+func getMimeType(data []byte, path string, defaultType string) string {
+	mimeType := http.DetectContentType(data)
+	if i := strings.IndexByte(mimeType, ';'); i >= 0 {
+		mimeType = mimeType[:i]
 	}
-	ext := filepath.Ext(strings.ToLower(img))
-	var imgFormat string
-	if ext == ".png" {
-		imgFormat = "png"
-	} else {
-		imgFormat = "jpeg"
+	if strings.HasPrefix(mimeType, "image/") ||
+		strings.HasPrefix(mimeType, "video/") ||
+		strings.HasPrefix(mimeType, "audio/") ||
+		mimeType == "application/ogg" {
+		return mimeType
+	}
+	if mimeType, ok := extMimeTypes[getLowerExtension(path)]; ok {
+		return mimeType
 	}
-	return fmt.Sprintf(`<div class="imgdiv"><img class="center-fit" src="data:image/%s;base64,%s"></img></div>`, imgFormat, base64.StdEncoding.EncodeToString(data))
+	return defaultType
 }
 
-func vidToHtml(folder string, vid string) string {
-	data, err := ioutil.ReadFile(filepath.Join(folder, vid))
+// get the src attribute of a media file: either a link relative to
+// linkFolder, or the base64 encoded file content if linkFolder is empty
+func getMediaSrc(folder string, name string, linkFolder string, defaultType string) (string, bool) {
+	if linkFolder != "" {
+		link := url.URL{Path: filepath.ToSlash(filepath.Join(linkFolder, name))}
+		return link.String(), true
+	}
+	data, err := ioutil.ReadFile(filepath.Join(folder, name))
 	if err != nil {
+		return "", false
+	}
+	mimeType := getMimeType(data, name, defaultType)
+	return fmt.Sprintf("data:%s;base64,%s", mimeType, base64.StdEncoding.EncodeToString(data)), true
+}
+
+func imgToHtml(folder string, img string, linkFolder string) string {
+	src, ok := getMediaSrc(folder, img, linkFolder, "image/jpeg")
+	if !ok {
 		return ""
 	}
-	return fmt.Sprintf(`<div class="viddiv"><video class="center-fit" controls src="data:video/mp4;base64,%s"></video></div>`, base64.StdEncoding.EncodeToString(data))
+	return fmt.Sprintf(`<div class="imgdiv"><img class="center-fit" src="%s"></img></div>`, src)
 }
 
-func wavToHtml(folder string, vid string) string {
-	data, err := ioutil.ReadFile(filepath.Join(folder, vid))
-	if err != nil {
+func vidToHtml(folder string, vid string, linkFolder string) string {
+	src, ok := getMediaSrc(folder, vid, linkFolder, "video/mp4")
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf(`<div class="viddiv"><video class="center-fit" controls src="%s"></video></div>`, src)
+}
+
+func wavToHtml(folder string, wav string, linkFolder string) string {
+	src, ok := getMediaSrc(folder, wav, linkFolder, "audio/x-wav")
+	if !ok {
 		return ""
 	}
-	return fmt.Sprintf(`<div align="center"><audio controls src="data:audio/x-wav;base64,%s"></audio></div>`, base64.StdEncoding.EncodeToString(data))
+	return fmt.Sprintf(`<div align="center"><audio controls src="%s"></audio></div>`, src)
 }
 
 var usage = `Usage: %s command options 
@@ -461,7 +699,7 @@ Where command can be:
     of creating an HTML album.
 
     Arguments:
-    - media_folder : the folder containing images and videos
+    - media_folder : the folder containing images, videos and audio files
     - output.alb   : the album file to be generated
     - num_cols     : optional, default=3. The number of columns to use when 
                      laying out images.  Videos will always be placed on a 
@@ -472,11 +710,21 @@ Where command can be:
     - custom.css   : optional, default=default.css : for pros: specify your 
                      custom CSS file
    
-  generate album_file
+  generate album_file [--link-media] [--jobs num_jobs]
     Generates the single-file HTML from an album file, with extension .html
 
     Arguments:
     - album_file   : the album file to be converted. If album_file is 
                      my_fotos.alb, the generated HTML file will be named 
                      my_fotos.html
+    - --link-media : optional. Reference the media by relative path instead 
+                     of embedding it into the HTML file. The same can be 
+                     achieved with a :link_media line in the album file.
+    - --jobs       : optional, default=number of CPUs. The maximum number of 
+                     media files loaded at the same time.
+
+Album file syntax:
+  Images on a media line can carry a caption, written after a | following
+  the image file name, e.g.: a.jpg | first caption   b.jpg | second one
+  A caption ends at the next word equal to the name of a media file.
 `
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetMimeType(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		path        string
+		defaultType string
+		want        string
+	}{
+		{"png named jpg", []byte("\x89PNG\r\n\x1a\n0000"), "fake.jpg", "image/jpeg", "image/png"},
+		{"gif", []byte("GIF89a0000"), "a.gif", "image/jpeg", "image/gif"},
+		{"webp", []byte("RIFF0000WEBPVP8 "), "a.webp", "image/jpeg", "image/webp"},
+		{"flac", []byte("fLaC\x00\x00\x00\x22"), "a.flac", "audio/x-wav", "audio/flac"},
+		{"text with jpg extension", []byte("not an image"), "a.jpg", "image/png", "image/jpeg"},
+		{"text with unknown extension", []byte("not an image"), "a.xyz", "image/jpeg", "image/jpeg"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := getMimeType(tt.data, tt.path, tt.defaultType)
+			if got != tt.want {
+				t.Errorf("getMimeType(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetLinkFolder(t *testing.T) {
+	tests := []struct {
+		name    string
+		outFile string
+		folder  string
+		want    string
+	}{
+		{"same directory", "album.html", "media", "media"},
+		{"output in subdirectory", "out/album.html", "media", "../media"},
+		{"media in parent", "album.html", "../media", "../media"},
+		{"media is output directory", "out/album.html", "out", "."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getLinkFolder(tt.outFile, tt.folder)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("getLinkFolder(%q, %q) = %q, want %q", tt.outFile, tt.folder, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMediaLine(t *testing.T) {
+	allMedia := map[string]*MediaFile{
+		"a.jpg": {path: "a.jpg"},
+		"b.jpg": {path: "b.jpg"},
+	}
+
+	tests := []struct {
+		name string
+		line string
+		want []MediaCell
+	}{
+		{"no captions", "a.jpg   b.jpg", []MediaCell{{"a.jpg", ""}, {"b.jpg", ""}}},
+		{"unknown file", "a.jpg c.jpg", []MediaCell{{"a.jpg", ""}, {"c.jpg", ""}}},
+		{"single caption", "a.jpg | A rainy morning", []MediaCell{{"a.jpg", "A rainy morning"}}},
+		{"no space before caption", "a.jpg|nospace", []MediaCell{{"a.jpg", "nospace"}}},
+		{"no space after bar", "a.jpg |caption", []MediaCell{{"a.jpg", "caption"}}},
+		{"caption per image", "a.jpg | first  b.jpg | second", []MediaCell{{"a.jpg", "first"}, {"b.jpg", "second"}}},
+		{"caption on second image", "a.jpg b.jpg | second", []MediaCell{{"a.jpg", ""}, {"b.jpg", "second"}}},
+		{"whitespace kept", "a.jpg | `x  y`  and | more", []MediaCell{{"a.jpg", "`x  y`  and | more"}}},
+		{"empty caption", "a.jpg |", []MediaCell{{"a.jpg", ""}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseMediaLine(tt.line, allMedia)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMediaLine(%q) = %v, want %v", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInlineMarkdownToHtml(t *testing.T) {
+	tests := []struct {
+		name     string
+		markdown string
+		want     string
+	}{
+		{"emphasis", "A *rainy* morning", "A <em>rainy</em> morning"},
+		{"heading marker", "# not a heading", "# not a heading"},
+		{"list marker", "- not a list", "- not a list"},
+		{"ordered list marker", "1. not a list", "1. not a list"},
+		{"script", "a <script>alert(1)</script>b", "a b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := inlineMarkdownToHtml(tt.markdown)
+			if got != tt.want {
+				t.Errorf("inlineMarkdownToHtml(%q) = %q, want %q", tt.markdown, got, tt.want)
+			}
+		})
+	}
+}